@@ -0,0 +1,246 @@
+package samlidp
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/zenazn/goji/web"
+
+	"github.com/shyce/saml"
+)
+
+// ServiceEventOp describes how a service's metadata changed.
+type ServiceEventOp string
+
+const (
+	ServiceEventAdded   ServiceEventOp = "added"
+	ServiceEventUpdated ServiceEventOp = "updated"
+	ServiceEventDeleted ServiceEventOp = "deleted"
+)
+
+// ServiceEvent is emitted whenever a service is added, updated, or deleted,
+// whether by a direct API call or by the metadata refresher.
+type ServiceEvent struct {
+	Op       ServiceEventOp         `json:"op"`
+	Name     string                 `json:"name"`
+	EntityID string                 `json:"entityID"`
+	Metadata *saml.EntityDescriptor `json:"metadata,omitempty"`
+}
+
+// eventRingBufferSize bounds how many past events are retained for
+// Last-Event-ID resume on the SSE endpoint.
+const eventRingBufferSize = 256
+
+// eventLogStoreKey is where the ring buffer is persisted in the Store, so
+// it survives a restart and can be shared by replicas that point at the
+// same Store.
+const eventLogStoreKey = "/events/log"
+
+// loggedEvent pairs a ServiceEvent with the monotonic ID it was assigned
+// when appended to the log, so subscribers never have to guess an event's
+// ID after the fact.
+type loggedEvent struct {
+	ID    uint64       `json:"id"`
+	Event ServiceEvent `json:"event"`
+}
+
+// eventLog is a bounded, sequence-numbered ring buffer of ServiceEvents,
+// backed by a Server's Store, letting a reconnecting SSE client replay
+// everything it missed since its last received event ID.
+type eventLog struct {
+	store Store
+
+	mu      sync.Mutex
+	nextID  uint64
+	entries []loggedEvent
+}
+
+// eventLog lazily loads the Server's persisted ring buffer from the Store
+// on first use, and creates it if none is stored yet.
+func (s *Server) eventLog() *eventLog {
+	s.eventsOnce.Do(func() {
+		l := &eventLog{store: s.Store}
+		var persisted []loggedEvent
+		if err := s.Store.Get(eventLogStoreKey, &persisted); err == nil {
+			l.entries = persisted
+			for _, entry := range persisted {
+				if entry.ID > l.nextID {
+					l.nextID = entry.ID
+				}
+			}
+		}
+		s.events = l
+	})
+	return s.events
+}
+
+func (l *eventLog) append(event ServiceEvent) loggedEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.nextID++
+	entry := loggedEvent{ID: l.nextID, Event: event}
+	l.entries = append(l.entries, entry)
+	if len(l.entries) > eventRingBufferSize {
+		l.entries = l.entries[len(l.entries)-eventRingBufferSize:]
+	}
+	if l.store != nil {
+		// Best effort: a failure to persist the ring buffer must not block
+		// delivery to live subscribers.
+		_ = l.store.Put(eventLogStoreKey, l.entries)
+	}
+	return entry
+}
+
+// since returns every logged event with ID > lastID, oldest first.
+func (l *eventLog) since(lastID uint64) []loggedEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make([]loggedEvent, 0, len(l.entries))
+	for _, entry := range l.entries {
+		if entry.ID > lastID {
+			out = append(out, entry)
+		}
+	}
+	return out
+}
+
+// RegisterEventHandlers wires the `GET /services/events` SSE endpoint onto
+// mux.
+func (s *Server) RegisterEventHandlers(mux *web.Mux) {
+	mux.Get("/services/events", s.HandleServiceEvents)
+}
+
+// Subscribe registers for live ServiceEvents and returns a channel of
+// future events plus an unsubscribe function. Callers embedding samlidp in
+// a larger control plane (multi-node IDP, cache warmers, audit sinks) can
+// use this to react to SP changes without polling HandleListServices.
+// The returned channel is closed by unsubscribe; callers must call it to
+// avoid leaking the subscription.
+func (s *Server) Subscribe() (<-chan ServiceEvent, func()) {
+	logged, unsubscribe := s.subscribeLogged()
+	out := make(chan ServiceEvent, eventRingBufferSize)
+	go func() {
+		defer close(out)
+		for entry := range logged {
+			out <- entry.Event
+		}
+	}()
+	return out, unsubscribe
+}
+
+// subscribeLogged is like Subscribe, but the returned channel carries each
+// event's assigned log ID alongside it, which HandleServiceEvents needs to
+// satisfy the Last-Event-ID resume contract.
+func (s *Server) subscribeLogged() (<-chan loggedEvent, func()) {
+	ch := make(chan loggedEvent, eventRingBufferSize)
+
+	s.subscribersMu.Lock()
+	if s.subscribers == nil {
+		s.subscribers = map[chan loggedEvent]struct{}{}
+	}
+	s.subscribers[ch] = struct{}{}
+	s.subscribersMu.Unlock()
+
+	unsubscribe := func() {
+		s.subscribersMu.Lock()
+		if _, ok := s.subscribers[ch]; ok {
+			delete(s.subscribers, ch)
+			close(ch)
+		}
+		s.subscribersMu.Unlock()
+	}
+	return ch, unsubscribe
+}
+
+// publishServiceEvent records event in the event log and fans the
+// resulting loggedEvent (carrying its assigned ID) out to every live
+// subscriber, dropping it for any subscriber whose channel is full rather
+// than blocking the mutation that triggered it.
+func (s *Server) publishServiceEvent(event ServiceEvent) {
+	entry := s.eventLog().append(event)
+
+	s.subscribersMu.Lock()
+	defer s.subscribersMu.Unlock()
+	for ch := range s.subscribers {
+		select {
+		case ch <- entry:
+		default:
+			s.log().Warn("sp.event.subscriber_slow", "entityID", event.EntityID)
+		}
+	}
+}
+
+// HandleServiceEvents handles `GET /services/events`, streaming
+// ServiceEvents as text/event-stream. A client that reconnects with a
+// Last-Event-ID header receives every event it missed from the bounded
+// ring buffer before the stream continues live.
+func (s *Server) HandleServiceEvents(_ web.C, w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	bw := bufio.NewWriter(w)
+
+	var lastID uint64
+	if v := r.Header.Get("Last-Event-ID"); v != "" {
+		lastID, _ = strconv.ParseUint(v, 10, 64)
+	}
+
+	// Subscribe before reading the backlog snapshot, so any event
+	// published in between is captured on live rather than falling into
+	// the gap between "already in the snapshot" and "registered to
+	// receive it live". The live stream is de-duplicated against the
+	// snapshot below by ID rather than skipped.
+	live, unsubscribe := s.subscribeLogged()
+	defer unsubscribe()
+
+	var maxSent uint64
+	for _, entry := range s.eventLog().since(lastID) {
+		if !writeSSE(bw, entry) {
+			return
+		}
+		maxSent = entry.ID
+	}
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case entry, ok := <-live:
+			if !ok {
+				return
+			}
+			if entry.ID <= maxSent {
+				// Already delivered as part of the backlog snapshot.
+				continue
+			}
+			if !writeSSE(bw, entry) {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func writeSSE(w *bufio.Writer, entry loggedEvent) bool {
+	data, err := json.Marshal(entry.Event)
+	if err != nil {
+		return false
+	}
+	if _, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n", entry.ID, data); err != nil {
+		return false
+	}
+	return w.Flush() == nil
+}
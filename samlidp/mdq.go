@@ -0,0 +1,201 @@
+package samlidp
+
+import (
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+	"github.com/zenazn/goji/web"
+
+	"github.com/shyce/saml"
+)
+
+// mdqValidity is how long an MDQ response's validUntil is set into the
+// future.
+const mdqValidity = 1 * time.Hour
+
+// RegisterMDQHandlers wires the SAML Metadata Query Protocol endpoints
+// (https://datatracker.ietf.org/doc/html/draft-young-md-query) onto mux,
+// backed by the same serviceProviders map used by GetServiceProvider. This
+// lets federation aggregators and sibling IDPs pull a single SP's metadata
+// by entityID hash instead of us publishing a flat file.
+func (s *Server) RegisterMDQHandlers(mux *web.Mux) {
+	mux.Get("/entities/", s.HandleMDQAll)
+	mux.Get("/entities/:id", s.HandleMDQEntity)
+}
+
+// HandleMDQEntity handles `GET /entities/{sha1:HEX}` and
+// `GET /entities/{urlEncodedEntityID}`, streaming a single
+// EntityDescriptor for a registered service provider.
+func (s *Server) HandleMDQEntity(c web.C, w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(s.log(), "request_id", requestID(r), "remote_addr", remoteAddr(r))
+
+	if !acceptsSAMLMetadata(r) {
+		http.Error(w, http.StatusText(http.StatusNotAcceptable), http.StatusNotAcceptable)
+		return
+	}
+
+	entityID, descriptor, ok := s.lookupByMDQID(c.URLParams["id"])
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	etag := mdqETag(entityID)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	if err := xml.NewEncoder(w).Encode(descriptor); err != nil {
+		logger.Error("mdq.entity.encode_failed", "sp_entity_id", entityID, "error", err)
+	}
+}
+
+// HandleMDQAll handles `GET /entities/`, streaming an EntitiesDescriptor
+// aggregate of every registered service provider, signed with the IDP's
+// signing key.
+func (s *Server) HandleMDQAll(_ web.C, w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(s.log(), "request_id", requestID(r), "remote_addr", remoteAddr(r))
+
+	if !acceptsSAMLMetadata(r) {
+		http.Error(w, http.StatusText(http.StatusNotAcceptable), http.StatusNotAcceptable)
+		return
+	}
+
+	s.idpConfigMu.RLock()
+	descriptors := make([]saml.EntityDescriptor, 0, len(s.serviceProviders))
+	for _, descriptor := range s.serviceProviders {
+		descriptors = append(descriptors, *descriptor)
+	}
+	s.idpConfigMu.RUnlock()
+
+	aggregate := struct {
+		XMLName     xml.Name                `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntitiesDescriptor"`
+		ValidUntil  time.Time               `xml:"validUntil,attr"`
+		Descriptors []saml.EntityDescriptor `xml:"EntityDescriptor"`
+	}{
+		ValidUntil:  time.Now().Add(mdqValidity),
+		Descriptors: descriptors,
+	}
+
+	doc := etree.NewDocument()
+	raw, err := xml.Marshal(aggregate)
+	if err != nil {
+		logger.Error("mdq.all.marshal_failed", "error", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if err := doc.ReadFromBytes(raw); err != nil {
+		logger.Error("mdq.all.reparse_failed", "error", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	signed, err := s.signMDQDocument(doc.Root())
+	if err != nil {
+		logger.Error("mdq.all.sign_failed", "error", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	signedDoc := etree.NewDocument()
+	signedDoc.SetRoot(signed)
+	if _, err := signedDoc.WriteTo(w); err != nil {
+		logger.Error("mdq.all.write_failed", "error", err)
+	}
+}
+
+// signMDQDocument signs root with the IDP's signing key.
+func (s *Server) signMDQDocument(root *etree.Element) (*etree.Element, error) {
+	if s.IDP.Key == nil || s.IDP.Certificate == nil {
+		return nil, fmt.Errorf("server has no IDP signing key configured")
+	}
+	keyStore := dsig.TLSCertKeyStore(tls.Certificate{
+		PrivateKey:  s.IDP.Key,
+		Certificate: [][]byte{s.IDP.Certificate.Raw},
+	})
+	ctx := dsig.NewDefaultSigningContext(keyStore)
+	return ctx.SignEnveloped(root)
+}
+
+// lookupByMDQID resolves id as a 40-character hex SHA-1 hash of an
+// entityID — bare, or in the `{sha1}HEX` / `sha1:HEX` form the MDQ
+// convention and `GET /entities/{sha1:HEX}` describe — or else as a
+// URL-encoded entityID, against the live serviceProviders map.
+func (s *Server) lookupByMDQID(id string) (entityID string, descriptor *saml.EntityDescriptor, ok bool) {
+	s.idpConfigMu.RLock()
+	defer s.idpConfigMu.RUnlock()
+
+	if hexID, isSHA1 := asSHA1Hex(id); isSHA1 {
+		for candidateID, candidate := range s.serviceProviders {
+			if strings.EqualFold(mdqSHA1Hex(candidateID), hexID) {
+				return candidateID, candidate, true
+			}
+		}
+		return "", nil, false
+	}
+
+	decoded, err := url.QueryUnescape(id)
+	if err != nil {
+		return "", nil, false
+	}
+	descriptor, ok = s.serviceProviders[decoded]
+	return decoded, descriptor, ok
+}
+
+// sha1Prefixes are the path-segment forms of a SHA-1 identifier accepted
+// by GET /entities/{sha1:HEX}, in addition to a bare 40-character hex
+// string.
+var sha1Prefixes = []string{"{sha1}", "sha1:"}
+
+// asSHA1Hex reports whether id names a SHA-1 hash, stripping any `{sha1}`
+// or `sha1:` prefix first, and returns the bare hex string to match
+// against.
+func asSHA1Hex(id string) (hexID string, ok bool) {
+	for _, prefix := range sha1Prefixes {
+		if len(id) > len(prefix) && strings.EqualFold(id[:len(prefix)], prefix) {
+			id = id[len(prefix):]
+			break
+		}
+	}
+	return id, looksLikeSHA1Hex(id)
+}
+
+func looksLikeSHA1Hex(s string) bool {
+	if len(s) != 40 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+func mdqSHA1Hex(entityID string) string {
+	sum := sha1.Sum([]byte(entityID))
+	return hex.EncodeToString(sum[:])
+}
+
+func mdqETag(entityID string) string {
+	return `"` + mdqSHA1Hex(entityID) + `"`
+}
+
+func acceptsSAMLMetadata(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return true
+	}
+	return strings.Contains(accept, "application/samlmetadata+xml") ||
+		strings.Contains(accept, "application/xml") ||
+		strings.Contains(accept, "*/*")
+}
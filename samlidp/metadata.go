@@ -0,0 +1,19 @@
+package samlidp
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+
+	"github.com/shyce/saml"
+)
+
+// getSPMetadata parses a service provider's EntityDescriptor from r, which
+// must contain XML-formatted SAML metadata.
+func getSPMetadata(r io.Reader) (*saml.EntityDescriptor, error) {
+	var metadata saml.EntityDescriptor
+	if err := xml.NewDecoder(r).Decode(&metadata); err != nil {
+		return nil, fmt.Errorf("cannot parse service provider metadata: %v", err)
+	}
+	return &metadata, nil
+}
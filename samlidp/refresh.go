@@ -0,0 +1,315 @@
+package samlidp
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+
+	"github.com/shyce/saml"
+)
+
+// Duration wraps time.Duration so it can be marshaled to and from the
+// human-readable strings (e.g. "24h") used in remote service registration
+// requests.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid refreshInterval %q: %v", s, err)
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// defaultRefreshInterval is used when a remote registration does not
+// specify a refreshInterval.
+const defaultRefreshInterval = 24 * time.Hour
+
+// RemoteMetadataSource describes a service provider whose metadata is
+// fetched over HTTPS and kept current by Server's metadata refresher,
+// rather than being registered once as inline XML.
+type RemoteMetadataSource struct {
+	// MetadataURL is fetched on RefreshInterval to obtain the current
+	// EntityDescriptor for this service provider.
+	MetadataURL string
+
+	// RefreshInterval is how often MetadataURL is re-fetched. Defaults to
+	// 24h if zero.
+	RefreshInterval Duration
+
+	// SigningCert, if set, is the PEM-encoded certificate that must have
+	// signed the fetched metadata. If empty, the certificate embedded in
+	// the first successfully fetched descriptor is pinned instead
+	// (trust-on-first-use) and must match on every subsequent fetch.
+	SigningCert string
+
+	// LearnedCert is the DER-encoded certificate pinned by TOFU, once a
+	// fetch has succeeded without a configured SigningCert.
+	LearnedCert []byte `json:",omitempty"`
+
+	// FailureCount is the number of consecutive failed refresh attempts.
+	// It is reset to zero on the next successful refresh.
+	FailureCount int `json:",omitempty"`
+
+	// LastAttempt is when this source was last refreshed, successfully or
+	// not. refreshDueServices uses it to gate each service's own
+	// RefreshInterval instead of refetching it on every tick of the
+	// refresher's ticker.
+	LastAttempt time.Time `json:",omitempty"`
+}
+
+// remoteServiceRequest is the JSON body accepted by HandlePutService for
+// registering a service provider whose metadata is fetched remotely.
+type remoteServiceRequest struct {
+	MetadataURL     string   `json:"metadataURL"`
+	RefreshInterval Duration `json:"refreshInterval"`
+	SigningCert     string   `json:"signingCert"`
+}
+
+// isRemoteServiceRequest reports whether r's body is the JSON remote
+// registration form rather than inline XML metadata.
+func isRemoteServiceRequest(r *http.Request) bool {
+	ct := r.Header.Get("Content-Type")
+	return ct == "application/json" || ct == "application/json; charset=utf-8"
+}
+
+// fetchRemoteMetadata retrieves and validates the EntityDescriptor at
+// metadataURL, pinning or checking against signingCert as described on
+// RemoteMetadataSource. learnedCert is the previously pinned TOFU
+// certificate, if any, and is returned updated.
+func fetchRemoteMetadata(ctx context.Context, client *http.Client, metadataURL, signingCert string, learnedCert []byte) (*saml.EntityDescriptor, []byte, error) {
+	parsed, err := url.Parse(metadataURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid metadataURL %q: %v", metadataURL, err)
+	}
+	if parsed.Scheme != "https" {
+		return nil, nil, fmt.Errorf("metadataURL %q must use https, got %q", metadataURL, parsed.Scheme)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, metadataURL, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot build request: %v", err)
+	}
+	req.Header.Set("Accept", "application/samlmetadata+xml")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot fetch %s: %v", metadataURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("fetching %s: unexpected status %s", metadataURL, resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot read body of %s: %v", metadataURL, err)
+	}
+
+	cert, err := validateMetadataSignature(body, signingCert, learnedCert)
+	if err != nil {
+		return nil, nil, fmt.Errorf("validating signature of %s: %v", metadataURL, err)
+	}
+
+	var descriptor saml.EntityDescriptor
+	if err := xml.NewDecoder(bytes.NewReader(body)).Decode(&descriptor); err != nil {
+		return nil, nil, fmt.Errorf("cannot parse metadata from %s: %v", metadataURL, err)
+	}
+	return &descriptor, cert, nil
+}
+
+// validateMetadataSignature checks doc's XML signature against pinnedCert
+// (PEM) if set, else against learnedCert (DER) if set, else it trusts
+// whichever certificate signed doc (trust-on-first-use). It returns the
+// DER-encoded certificate that should be pinned for future fetches.
+func validateMetadataSignature(doc []byte, pinnedCert string, learnedCert []byte) ([]byte, error) {
+	root := etree.NewDocument()
+	if err := root.ReadFromBytes(doc); err != nil {
+		return nil, fmt.Errorf("cannot parse metadata XML: %v", err)
+	}
+	if root.Root() == nil {
+		return nil, fmt.Errorf("cannot parse metadata XML: no root element")
+	}
+
+	embedded, err := signingCertFromSignature(root.Root())
+	if err != nil {
+		return nil, fmt.Errorf("metadata is not signed: %v", err)
+	}
+
+	trusted := embedded
+	switch {
+	case pinnedCert != "":
+		block, _ := pem.Decode([]byte(pinnedCert))
+		if block == nil {
+			return nil, fmt.Errorf("signingCert is not valid PEM")
+		}
+		if trusted, err = x509.ParseCertificate(block.Bytes); err != nil {
+			return nil, fmt.Errorf("cannot parse signingCert: %v", err)
+		}
+	case len(learnedCert) > 0:
+		if trusted, err = x509.ParseCertificate(learnedCert); err != nil {
+			return nil, fmt.Errorf("cannot parse pinned certificate: %v", err)
+		}
+	}
+
+	if !trusted.Equal(embedded) {
+		return nil, fmt.Errorf("metadata was signed by an unexpected certificate")
+	}
+
+	validationCtx := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{
+		Roots: []*x509.Certificate{trusted},
+	})
+	if _, err := validationCtx.Validate(root.Root()); err != nil {
+		return nil, fmt.Errorf("signature validation failed: %v", err)
+	}
+	return trusted.Raw, nil
+}
+
+// signingCertFromSignature extracts the X.509 certificate embedded in
+// root's ds:Signature/KeyInfo.
+func signingCertFromSignature(root *etree.Element) (*x509.Certificate, error) {
+	certEl := root.FindElement(".//Signature/KeyInfo/X509Data/X509Certificate")
+	if certEl == nil {
+		return nil, fmt.Errorf("no ds:X509Certificate found in KeyInfo")
+	}
+	der, err := base64.StdEncoding.DecodeString(strings.TrimSpace(certEl.Text()))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode embedded certificate: %v", err)
+	}
+	return x509.ParseCertificate(der)
+}
+
+// RefreshService re-fetches and re-validates the metadata for the named
+// service, if it was registered with a MetadataURL, and swaps it into the
+// live serviceProviders map on success. On failure the previously served
+// metadata is left in place and the service's failure counter is
+// incremented.
+func (s *Server) RefreshService(name string) error {
+	service := Service{}
+	if err := s.Store.Get(fmt.Sprintf("/services/%s", name), &service); err != nil {
+		return fmt.Errorf("cannot load service %s: %v", name, err)
+	}
+	if service.Remote == nil {
+		return fmt.Errorf("service %s has no remote metadata source", name)
+	}
+
+	logger := requestLogger(s.log(), "name", name, "metadata_url", service.Remote.MetadataURL)
+
+	descriptor, cert, err := fetchRemoteMetadata(context.Background(), s.httpClient(), service.Remote.MetadataURL, service.Remote.SigningCert, service.Remote.LearnedCert)
+	service.Remote.LastAttempt = time.Now()
+	if err != nil {
+		service.Remote.FailureCount++
+		logger.Warn("sp.refresh.failed", "error", err, "failure_count", service.Remote.FailureCount)
+		if putErr := s.Store.Put(fmt.Sprintf("/services/%s", name), &service); putErr != nil {
+			logger.Error("sp.refresh.failure_count_not_persisted", "error", putErr)
+		}
+		return err
+	}
+
+	service.Metadata = *descriptor
+	service.Remote.FailureCount = 0
+	if service.Remote.SigningCert == "" {
+		service.Remote.LearnedCert = cert
+	}
+	if err := s.Store.Put(fmt.Sprintf("/services/%s", name), &service); err != nil {
+		logger.Error("sp.refresh.store_failed", "error", err)
+		return err
+	}
+
+	s.idpConfigMu.Lock()
+	s.serviceProviders[service.Metadata.EntityID] = &service.Metadata
+	s.idpConfigMu.Unlock()
+
+	logger.Info("sp.refreshed", "entityID", service.Metadata.EntityID)
+	s.publishServiceEvent(ServiceEvent{
+		Op:       ServiceEventUpdated,
+		Name:     name,
+		EntityID: service.Metadata.EntityID,
+		Metadata: &service.Metadata,
+	})
+	return nil
+}
+
+// RunMetadataRefresher walks every registered service on each tick of
+// interval, refreshing the ones with a remote metadata source whose own
+// RefreshInterval has elapsed since its last attempt, until ctx is
+// canceled. interval is a poll cadence, not the refresh cadence itself —
+// pass something no coarser than the shortest RefreshInterval in use.
+// Callers run it in its own goroutine, e.g. `go
+// srv.RunMetadataRefresher(ctx, time.Minute)`.
+func (s *Server) RunMetadataRefresher(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.refreshDueServices()
+		}
+	}
+}
+
+func (s *Server) refreshDueServices() {
+	names, err := s.Store.List("/services/")
+	if err != nil {
+		s.log().Error("sp.refresh.list_failed", "error", err)
+		return
+	}
+	for _, name := range names {
+		service := Service{}
+		if err := s.Store.Get(fmt.Sprintf("/services/%s", name), &service); err != nil {
+			s.log().Error("sp.refresh.load_failed", "name", name, "error", err)
+			continue
+		}
+		if service.Remote == nil {
+			continue
+		}
+
+		interval := time.Duration(service.Remote.RefreshInterval)
+		if interval <= 0 {
+			interval = defaultRefreshInterval
+		}
+		if time.Since(service.Remote.LastAttempt) < interval {
+			continue
+		}
+
+		if err := s.RefreshService(name); err != nil {
+			// RefreshService already logged a structured warning.
+			continue
+		}
+	}
+}
+
+// httpClient returns the HTTP client used to fetch remote metadata.
+func (s *Server) httpClient() *http.Client {
+	return &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{MinVersion: tls.VersionTLS12},
+		},
+	}
+}
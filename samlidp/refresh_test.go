@@ -0,0 +1,182 @@
+package samlidp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+const testEntityID = "https://sp.example.com/metadata"
+
+func generateTestCert(t *testing.T) (*rsa.PrivateKey, *x509.Certificate) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test-sp"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("creating certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parsing certificate: %v", err)
+	}
+	return key, cert
+}
+
+func certToPEM(cert *x509.Certificate) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+}
+
+func unsignedTestMetadata() []byte {
+	return []byte(`<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" entityID="` + testEntityID + `"></EntityDescriptor>`)
+}
+
+func signTestMetadata(t *testing.T, key *rsa.PrivateKey, cert *x509.Certificate) []byte {
+	t.Helper()
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(unsignedTestMetadata()); err != nil {
+		t.Fatalf("parsing fixture: %v", err)
+	}
+
+	keyStore := dsig.TLSCertKeyStore(tls.Certificate{
+		PrivateKey:  key,
+		Certificate: [][]byte{cert.Raw},
+	})
+	signed, err := dsig.NewDefaultSigningContext(keyStore).SignEnveloped(doc.Root())
+	if err != nil {
+		t.Fatalf("signing fixture: %v", err)
+	}
+
+	signedDoc := etree.NewDocument()
+	signedDoc.SetRoot(signed)
+	out, err := signedDoc.WriteToBytes()
+	if err != nil {
+		t.Fatalf("serializing signed fixture: %v", err)
+	}
+	return out
+}
+
+func TestValidateMetadataSignature(t *testing.T) {
+	key, cert := generateTestCert(t)
+	signed := signTestMetadata(t, key, cert)
+
+	_, otherCert := generateTestCert(t)
+
+	tampered := []byte(strings.Replace(string(signed), "sp.example.com", "evil.example.com", 1))
+
+	tests := []struct {
+		name        string
+		doc         []byte
+		pinnedCert  string
+		learnedCert []byte
+		wantErr     bool
+	}{
+		{name: "tofu trusts the embedded cert", doc: signed, wantErr: false},
+		{name: "pinned cert matches signer", doc: signed, pinnedCert: certToPEM(cert), wantErr: false},
+		{name: "pinned cert does not match signer", doc: signed, pinnedCert: certToPEM(otherCert), wantErr: true},
+		{name: "learned cert matches signer", doc: signed, learnedCert: cert.Raw, wantErr: false},
+		{name: "learned cert does not match signer", doc: signed, learnedCert: otherCert.Raw, wantErr: true},
+		{name: "unsigned document is rejected", doc: unsignedTestMetadata(), wantErr: true},
+		{name: "garbled pinned PEM is rejected", doc: signed, pinnedCert: "not a pem certificate", wantErr: true},
+		{name: "tampered document fails signature check", doc: tampered, wantErr: true},
+		{name: "malformed XML is rejected", doc: []byte("<not-xml"), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := validateMetadataSignature(tt.doc, tt.pinnedCert, tt.learnedCert)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateMetadataSignature() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFetchRemoteMetadataRejectsNonHTTPS(t *testing.T) {
+	_, _, err := fetchRemoteMetadata(context.Background(), http.DefaultClient, "http://sp.example.com/metadata", "", nil)
+	if err == nil {
+		t.Fatal("fetchRemoteMetadata() error = nil, want an error for a non-https metadataURL")
+	}
+}
+
+func TestFetchRemoteMetadataErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{
+			name: "non-200 status",
+			handler: func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusInternalServerError)
+			},
+		},
+		{
+			name: "malformed XML body",
+			handler: func(w http.ResponseWriter, _ *http.Request) {
+				w.Write([]byte("not xml"))
+			},
+		},
+		{
+			name: "unsigned metadata",
+			handler: func(w http.ResponseWriter, _ *http.Request) {
+				w.Write(unsignedTestMetadata())
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewTLSServer(tt.handler)
+			defer srv.Close()
+
+			if _, _, err := fetchRemoteMetadata(context.Background(), srv.Client(), srv.URL, "", nil); err == nil {
+				t.Fatal("fetchRemoteMetadata() error = nil, want an error")
+			}
+		})
+	}
+}
+
+func TestFetchRemoteMetadataSucceedsWithPinnedCert(t *testing.T) {
+	key, cert := generateTestCert(t)
+	signed := signTestMetadata(t, key, cert)
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write(signed)
+	}))
+	defer srv.Close()
+
+	descriptor, gotCert, err := fetchRemoteMetadata(context.Background(), srv.Client(), srv.URL, certToPEM(cert), nil)
+	if err != nil {
+		t.Fatalf("fetchRemoteMetadata() error = %v", err)
+	}
+	if descriptor.EntityID != testEntityID {
+		t.Fatalf("descriptor.EntityID = %q, want %q", descriptor.EntityID, testEntityID)
+	}
+	if !bytes.Equal(gotCert, cert.Raw) {
+		t.Fatal("fetchRemoteMetadata() returned cert does not match the pinned cert")
+	}
+}
@@ -0,0 +1,60 @@
+package samlidp
+
+import (
+	"sync"
+
+	"github.com/shyce/saml"
+)
+
+// Store is the interface that must be implemented by the storage backend
+// that holds configured services (and any other state `samlidp` persists).
+type Store interface {
+	Get(key string, value interface{}) error
+	Put(key string, value interface{}) error
+	List(prefix string) ([]string, error)
+	Delete(key string) error
+}
+
+// Server implements the SAML identity provider endpoints (SSO, metadata,
+// and service management) on top of a Store.
+type Server struct {
+	Store Store
+
+	// IDP is the identity provider presented to connecting service
+	// providers; its Key and Certificate are also used to sign MDQ
+	// metadata responses.
+	IDP saml.IdentityProvider
+
+	idpConfigMu      sync.RWMutex
+	serviceProviders map[string]*saml.EntityDescriptor
+
+	// Logger receives structured log events emitted by the server. If nil,
+	// log() lazily falls back to a zap-backed default the first time it is
+	// needed. Existing callers that built a Server before structured
+	// logging was introduced can still set Logger to NewStdLogger(theirLog)
+	// to keep their output.
+	Logger Logger
+
+	loggerOnce     sync.Once
+	resolvedLogger Logger
+
+	// events, eventsOnce and subscribers back Subscribe and the SSE
+	// change-notification stream; see events.go.
+	events        *eventLog
+	eventsOnce    sync.Once
+	subscribersMu sync.Mutex
+	subscribers   map[chan loggedEvent]struct{}
+}
+
+// log returns the Server's effective Logger, resolving to a zap-backed
+// default the first time it is called if Logger was never set.
+func (s *Server) log() Logger {
+	s.loggerOnce.Do(func() {
+		if s.Logger != nil {
+			s.resolvedLogger = s.Logger
+		} else {
+			s.resolvedLogger = defaultLogger()
+		}
+	})
+	return s.resolvedLogger
+}
@@ -19,6 +19,11 @@ type Service struct {
 
 	// Metdata is the XML metadata of the service provider.
 	Metadata saml.EntityDescriptor
+
+	// Remote, if set, means Metadata was fetched from MetadataURL rather
+	// than registered inline, and is kept current by the metadata
+	// refresher instead of requiring a manual PUT.
+	Remote *RemoteMetadataSource `json:",omitempty"`
 }
 
 func (s *Server) AddService(service *Service) error {
@@ -35,7 +40,13 @@ func (s *Server) AddService(service *Service) error {
 	s.serviceProviders[service.Metadata.EntityID] = &service.Metadata
 	s.idpConfigMu.Unlock()
 
-	s.logger.Printf("Added service: %s (EntityID: %s)", service.Name, service.Metadata.EntityID)
+	s.log().Info("sp.added", "name", service.Name, "entityID", service.Metadata.EntityID)
+	s.publishServiceEvent(ServiceEvent{
+		Op:       ServiceEventAdded,
+		Name:     service.Name,
+		EntityID: service.Metadata.EntityID,
+		Metadata: &service.Metadata,
+	})
 	return nil
 }
 
@@ -43,27 +54,29 @@ func (s *Server) AddService(service *Service) error {
 // service provider ID, which is typically the service provider's
 // metadata URL. If an appropriate service provider cannot be found then
 // the returned error must be os.ErrNotExist.
-func (s *Server) GetServiceProvider(_ *http.Request, serviceProviderID string) (*saml.EntityDescriptor, error) {
+func (s *Server) GetServiceProvider(r *http.Request, serviceProviderID string) (*saml.EntityDescriptor, error) {
+	logger := requestLogger(s.log(), "request_id", requestID(r), "remote_addr", remoteAddr(r), "sp_entity_id", serviceProviderID)
+
 	s.idpConfigMu.RLock()
 	defer s.idpConfigMu.RUnlock()
-	s.logger.Printf("Looking up service provider with ID: %s", serviceProviderID)
-	s.logger.Printf("Current serviceProviders map: %+v", s.serviceProviders)
+	logger.Debug("sp.lookup", "serviceProviders", s.serviceProviders)
 	rv, ok := s.serviceProviders[serviceProviderID]
 	if !ok {
-		s.logger.Printf("Service provider not found: %s", serviceProviderID)
+		logger.Warn("sp.lookup.miss")
 		return nil, os.ErrNotExist
 	}
-	s.logger.Printf("Found service provider: %s", serviceProviderID)
-	s.logger.Printf("Service provider details: %+v", rv)
+	logger.Debug("sp.lookup.hit", "metadata", rv)
 	return rv, nil
 }
 
 // HandleListServices handles the `GET /services/` request and responds with a JSON formatted list
 // of service names.
-func (s *Server) HandleListServices(_ web.C, w http.ResponseWriter, _ *http.Request) {
+func (s *Server) HandleListServices(_ web.C, w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(s.log(), "request_id", requestID(r), "remote_addr", remoteAddr(r))
+
 	services, err := s.Store.List("/services/")
 	if err != nil {
-		s.logger.Printf("ERROR: %s", err)
+		logger.Error("services.list.failed", "error", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
@@ -72,45 +85,82 @@ func (s *Server) HandleListServices(_ web.C, w http.ResponseWriter, _ *http.Requ
 		Services []string `json:"services"`
 	}{Services: services})
 	if err != nil {
-		s.logger.Printf("ERROR: %s", err)
+		logger.Error("services.list.encode_failed", "error", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 	}
 }
 
 // HandleGetService handles the `GET /services/:id` request and responds with the service
 // metadata in XML format.
-func (s *Server) HandleGetService(c web.C, w http.ResponseWriter, _ *http.Request) {
+func (s *Server) HandleGetService(c web.C, w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(s.log(), "request_id", requestID(r), "remote_addr", remoteAddr(r), "sp_entity_id", c.URLParams["id"])
+
 	service := Service{}
 	err := s.Store.Get(fmt.Sprintf("/services/%s", c.URLParams["id"]), &service)
 	if err != nil {
-		s.logger.Printf("ERROR: %s", err)
+		logger.Error("sp.get.failed", "error", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 	err = xml.NewEncoder(w).Encode(service.Metadata)
 	if err != nil {
-		s.logger.Printf("ERROR: %s", err)
+		logger.Error("sp.get.encode_failed", "error", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 	}
 }
 
-// HandlePutService handles the `PUT /shortcuts/:id` request. It accepts the XML-formatted
-// service metadata in the request body and stores it.
+// HandlePutService handles the `PUT /services/:id` request. It accepts either
+// XML-formatted service metadata in the request body, or (with a
+// `Content-Type: application/json` body) a remote registration of the form
+// `{"metadataURL": "...", "refreshInterval": "24h", "signingCert": "..."}`,
+// which is fetched, signature-checked, and kept current by the metadata
+// refresher.
 func (s *Server) HandlePutService(c web.C, w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(s.log(), "request_id", requestID(r), "remote_addr", remoteAddr(r))
+
 	service := Service{}
 
-	metadata, err := getSPMetadata(r.Body)
-	if err != nil {
-		s.logger.Printf("ERROR: %s", err)
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-		return
-	}
+	if isRemoteServiceRequest(r) {
+		var reg remoteServiceRequest
+		if err := json.NewDecoder(r.Body).Decode(&reg); err != nil {
+			logger.Warn("sp.put.bad_remote_request", "error", err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if reg.RefreshInterval == 0 {
+			reg.RefreshInterval = Duration(defaultRefreshInterval)
+		}
+
+		metadata, cert, err := fetchRemoteMetadata(r.Context(), s.httpClient(), reg.MetadataURL, reg.SigningCert, nil)
+		if err != nil {
+			logger.Warn("sp.put.remote_fetch_failed", "metadata_url", reg.MetadataURL, "error", err)
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			return
+		}
 
-	service.Metadata = *metadata
+		service.Metadata = *metadata
+		service.Remote = &RemoteMetadataSource{
+			MetadataURL:     reg.MetadataURL,
+			RefreshInterval: reg.RefreshInterval,
+			SigningCert:     reg.SigningCert,
+		}
+		if reg.SigningCert == "" {
+			service.Remote.LearnedCert = cert
+		}
+	} else {
+		metadata, err := getSPMetadata(r.Body)
+		if err != nil {
+			logger.Warn("sp.put.bad_metadata", "error", err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		service.Metadata = *metadata
+	}
+	logger = requestLogger(s.log(), "request_id", requestID(r), "remote_addr", remoteAddr(r), "sp_entity_id", service.Metadata.EntityID)
 
-	err = s.Store.Put(fmt.Sprintf("/services/%s", c.URLParams["id"]), &service)
+	err := s.Store.Put(fmt.Sprintf("/services/%s", c.URLParams["id"]), &service)
 	if err != nil {
-		s.logger.Printf("ERROR: %s", err)
+		logger.Error("sp.put.store_failed", "error", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
@@ -119,21 +169,30 @@ func (s *Server) HandlePutService(c web.C, w http.ResponseWriter, r *http.Reques
 	s.serviceProviders[service.Metadata.EntityID] = &service.Metadata
 	s.idpConfigMu.Unlock()
 
+	logger.Info("sp.updated", "name", c.URLParams["id"])
+	s.publishServiceEvent(ServiceEvent{
+		Op:       ServiceEventUpdated,
+		Name:     c.URLParams["id"],
+		EntityID: service.Metadata.EntityID,
+		Metadata: &service.Metadata,
+	})
 	w.WriteHeader(http.StatusNoContent)
 }
 
 // HandleDeleteService handles the `DELETE /services/:id` request.
-func (s *Server) HandleDeleteService(c web.C, w http.ResponseWriter, _ *http.Request) {
+func (s *Server) HandleDeleteService(c web.C, w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(s.log(), "request_id", requestID(r), "remote_addr", remoteAddr(r))
+
 	service := Service{}
 	err := s.Store.Get(fmt.Sprintf("/services/%s", c.URLParams["id"]), &service)
 	if err != nil {
-		s.logger.Printf("ERROR: %s", err)
+		logger.Error("sp.delete.get_failed", "error", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 
 	if err := s.Store.Delete(fmt.Sprintf("/services/%s", c.URLParams["id"])); err != nil {
-		s.logger.Printf("ERROR: %s", err)
+		logger.Error("sp.delete.failed", "error", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
@@ -142,6 +201,12 @@ func (s *Server) HandleDeleteService(c web.C, w http.ResponseWriter, _ *http.Req
 	delete(s.serviceProviders, service.Metadata.EntityID)
 	s.idpConfigMu.Unlock()
 
+	logger.Info("sp.deleted", "name", c.URLParams["id"], "entityID", service.Metadata.EntityID)
+	s.publishServiceEvent(ServiceEvent{
+		Op:       ServiceEventDeleted,
+		Name:     c.URLParams["id"],
+		EntityID: service.Metadata.EntityID,
+	})
 	w.WriteHeader(http.StatusNoContent)
 }
 
@@ -152,19 +217,19 @@ func (s *Server) initializeServices() error {
 	if err != nil {
 		return err
 	}
-	s.logger.Printf("Initializing %d services", len(serviceNames))
+	s.log().Info("services.init.start", "count", len(serviceNames))
 	for _, serviceName := range serviceNames {
 		service := Service{}
 		if err := s.Store.Get(fmt.Sprintf("/services/%s", serviceName), &service); err != nil {
-			s.logger.Printf("Error loading service %s: %v", serviceName, err)
+			s.log().Error("services.init.load_failed", "name", serviceName, "error", err)
 			return err
 		}
 
-		s.logger.Printf("Loaded service: %s (EntityID: %s)", serviceName, service.Metadata.EntityID)
+		s.log().Info("services.init.loaded", "name", serviceName, "entityID", service.Metadata.EntityID)
 		s.idpConfigMu.Lock()
 		s.serviceProviders[service.Metadata.EntityID] = &service.Metadata
 		s.idpConfigMu.Unlock()
 	}
-	s.logger.Printf("Initialized services. Current serviceProviders map: %+v", s.serviceProviders)
+	s.log().Debug("services.init.done", "serviceProviders", s.serviceProviders)
 	return nil
 }